@@ -0,0 +1,281 @@
+package warc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// RecordIndex describes the location of a single WARC record stored as its
+// own gzip member inside a per-record gzip compressed WARC file, along with
+// the handful of header fields callers typically need to locate a record
+// without decompressing it.
+type RecordIndex struct {
+	Offset        int64  `json:"offset"`
+	CompressedLen int64  `json:"length"`
+	RecordID      string `json:"warc-record-id"`
+	TargetURI     string `json:"warc-target-uri"`
+	Date          string `json:"warc-date"`
+}
+
+// IndexedReader provides random access to the records of a per-record gzip
+// compressed WARC file through an io.ReaderAt. Unlike Reader, which only
+// supports sequential access, IndexedReader scans the file once to build an
+// index of every record's offset, and from then on can decompress any
+// single record without touching the records around it.
+type IndexedReader struct {
+	source  io.ReaderAt
+	records []RecordIndex
+}
+
+// countingReader wraps an io.Reader and counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewIndexedReader scans source once, recording the offset and a few header
+// fields of every WARC record it contains.
+func NewIndexedReader(source io.ReaderAt) (*IndexedReader, error) {
+	records, err := scanRecords(source)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexedReader{
+		source:  source,
+		records: records,
+	}, nil
+}
+
+// NewIndexedReaderFromIndex creates an IndexedReader from an index
+// previously written by IndexWriter, skipping the initial scan of source.
+func NewIndexedReaderFromIndex(source io.ReaderAt, records []RecordIndex) *IndexedReader {
+	return &IndexedReader{
+		source:  source,
+		records: records,
+	}
+}
+
+// scanRecords walks source from the beginning, decompressing each gzip
+// member to read its WARC header and to find where the member ends, and
+// returns the offset and length of every member found.
+func scanRecords(source io.ReaderAt) ([]RecordIndex, error) {
+	var records []RecordIndex
+	offset := int64(0)
+	for {
+		cr := &countingReader{r: io.NewSectionReader(source, offset, 1<<62)}
+		br := bufio.NewReader(cr)
+		if _, err := br.Peek(1); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		gzipReader, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		gzipReader.Multistream(false)
+
+		hbr := bufio.NewReader(gzipReader)
+		header, err := readRecordHeader(hbr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(ioutil.Discard, hbr); err != nil {
+			return nil, err
+		}
+		gzipReader.Close()
+
+		length := cr.n - int64(br.Buffered())
+		records = append(records, RecordIndex{
+			Offset:        offset,
+			CompressedLen: length,
+			RecordID:      header.Get("warc-record-id"),
+			TargetURI:     header.Get("warc-target-uri"),
+			Date:          header.Get("warc-date"),
+		})
+		offset += length
+	}
+	return records, nil
+}
+
+// readRecordHeader reads the WARC version line and the record header block
+// from r, mirroring the header parsing Reader.ReadRecord does for
+// sequential access.
+func readRecordHeader(r *bufio.Reader) (Header, error) {
+	if _, err := r.ReadString('\n'); err != nil {
+		return nil, err
+	}
+	header := NewHeader()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if len(line) > maxLineLength {
+			return nil, fmt.Errorf("warc: header line exceeds %d bytes", maxLineLength)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if key, value := splitKeyValue(line); key != "" {
+			header.Set(key, value)
+		}
+	}
+	return header, nil
+}
+
+// Records returns the index of every record found while scanning, in the
+// order the records appear in the file.
+func (ir *IndexedReader) Records() []RecordIndex {
+	return ir.records
+}
+
+// ReadAt decompresses and returns the record at position idx in Records().
+func (ir *IndexedReader) ReadAt(idx int) (*Record, error) {
+	if idx < 0 || idx >= len(ir.records) {
+		return nil, fmt.Errorf("warc: record index %d out of range", idx)
+	}
+	ri := ir.records[idx]
+	section := io.NewSectionReader(ir.source, ri.Offset, ri.CompressedLen)
+	gzipReader, err := gzip.NewReader(section)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(gzipReader)
+	header, err := readRecordHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header["content-length"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse field Content-Length: %v", err)
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("field Content-Length must not be negative, got %d", length)
+	}
+	content, err := sliceReader(br, length, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{
+		Header:  header,
+		Content: content,
+	}, nil
+}
+
+// RawRecord returns the still gzip-compressed bytes of the record at
+// position idx in Records(), along with its parsed header. Callers that
+// want to relay or filter records rather than read their content can use
+// Writer.CopyRecordRaw, which copies the same member bytes straight from
+// the IndexedReader, to avoid a decompress/recompress round trip.
+func (ir *IndexedReader) RawRecord(idx int) (Header, []byte, error) {
+	if idx < 0 || idx >= len(ir.records) {
+		return nil, nil, fmt.Errorf("warc: record index %d out of range", idx)
+	}
+	ri := ir.records[idx]
+	section := io.NewSectionReader(ir.source, ri.Offset, ri.CompressedLen)
+	raw, err := ioutil.ReadAll(section)
+	if err != nil {
+		return nil, nil, err
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gzipReader.Close()
+	header, err := readRecordHeader(bufio.NewReader(gzipReader))
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, raw, nil
+}
+
+// Find returns the index of the record with the given WARC-Record-ID, or -1
+// if Records contains no such record.
+func (ir *IndexedReader) Find(recordID string) int {
+	for i, ri := range ir.records {
+		if ri.RecordID == recordID {
+			return i
+		}
+	}
+	return -1
+}
+
+// CopyRecordRaw copies the record described by idx, an entry of
+// src.Records(), straight into the Writer's target, without decompressing and recompressing it.
+// This is only safe when src is itself a per-record gzip compressed WARC
+// file and the Writer is being used in that same per-record gzip mode, so
+// that the copied gzip member keeps the destination a valid concatenation
+// of members. It makes filtering or repackaging large crawls (for example,
+// extracting only the response records for a list of URLs) an order of
+// magnitude cheaper than reading and rewriting every record.
+//
+// CopyRecordRaw reads from an IndexedReader, and RawRecord lives on
+// IndexedReader rather than Reader: random access to a raw, still-compressed member only makes sense
+// once the file has been scanned into offsets, which is exactly what
+// IndexedReader provides and Reader doesn't.
+//
+// CopyRecordRaw returns an error if w was not constructed for per-record
+// gzip output, since writing the raw member to any other destination would
+// silently produce a corrupt file.
+func (w *Writer) CopyRecordRaw(src *IndexedReader, idx RecordIndex) (int64, error) {
+	if w.gzipw == nil || !w.opts.PerRecordGzip {
+		return 0, fmt.Errorf("warc: CopyRecordRaw requires a Writer in per-record gzip mode")
+	}
+	section := io.NewSectionReader(src.source, idx.Offset, idx.CompressedLen)
+	return io.Copy(w.target, section)
+}
+
+// IndexWriter writes a CDXJ-style index of a per-record gzip compressed
+// WARC file: one JSON object per line, carrying the same fields as
+// RecordIndex. An index written this way can be read back with LoadIndex so
+// that later opens of the WARC file can skip NewIndexedReader's initial
+// scan.
+type IndexWriter struct {
+	target io.Writer
+}
+
+// NewIndexWriter creates a new IndexWriter.
+func NewIndexWriter(target io.Writer) *IndexWriter {
+	return &IndexWriter{target}
+}
+
+// Write appends records to the index, one JSON line each.
+func (iw *IndexWriter) Write(records []RecordIndex) error {
+	enc := json.NewEncoder(iw.target)
+	for _, ri := range records {
+		if err := enc.Encode(ri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadIndex reads an index previously written by IndexWriter.
+func LoadIndex(r io.Reader) ([]RecordIndex, error) {
+	var records []RecordIndex
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var ri RecordIndex
+		if err := dec.Decode(&ri); err != nil {
+			return nil, err
+		}
+		records = append(records, ri)
+	}
+	return records, nil
+}
@@ -6,9 +6,16 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"encoding/base32"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -67,8 +74,51 @@ type Reader struct {
 
 // Writer writes WARC records to WARC files.
 type Writer struct {
+	// ComputeDigests makes WriteRecord compute WARC-Block-Digest, and
+	// WARC-Payload-Digest for application/http records, on every record
+	// that doesn't already carry one.
+	ComputeDigests bool
+	// HashAlgorithm selects the hash used for digests when ComputeDigests is
+	// set. The zero value defaults to crypto.SHA1, the algorithm most WARC
+	// tools expect.
+	HashAlgorithm crypto.Hash
+	// SpoolThreshold sets the content size from which WriteRecord writes the
+	// whole content to a temporary file instead of buffering it in memory;
+	// shorter content stays in memory. Zero disables spooling and always
+	// buffers the whole record in memory.
+	SpoolThreshold int64
+
 	// Unexported fields.
-	target io.Writer
+	target   io.Writer
+	opts     WriterOptions
+	gzipw    *gzip.Writer
+	gzipUsed bool // whether gzipw has ever written a record, see Close
+}
+
+// WriterOptions configures a Writer. The zero value writes uncompressed
+// records without digests, matching NewWriter.
+type WriterOptions struct {
+	// Compression selects the compression format applied to written
+	// records. CompressionBZIP is not supported, since the standard library
+	// provides no bzip2 writer. zstd is not offered either: it would be
+	// this package's first dependency outside the standard library, which
+	// is out of scope here.
+	Compression CompressionType
+	// Level is the compression level passed to the underlying compressor.
+	// It uses the same scale as compress/gzip, e.g. gzip.DefaultCompression,
+	// gzip.BestSpeed or gzip.BestCompression.
+	Level int
+	// PerRecordGzip, when Compression is CompressionGZIP, makes the Writer
+	// emit one independent gzip member per record instead of wrapping the
+	// whole output in a single member. This is the framing most WARC tools
+	// expect, and the one IndexedReader requires.
+	PerRecordGzip bool
+	// ComputeDigests sets Writer.ComputeDigests.
+	ComputeDigests bool
+	// DigestAlgorithm sets Writer.HashAlgorithm.
+	DigestAlgorithm crypto.Hash
+	// SpoolThreshold sets Writer.SpoolThreshold.
+	SpoolThreshold int64
 }
 
 // Header provides information about the WARC record. It stores WARC record
@@ -86,6 +136,11 @@ const (
 	CompressionNone CompressionType = iota
 	CompressionBZIP
 	CompressionGZIP
+	// zstd is deliberately not offered here: it would be the first
+	// dependency outside the standard library, and this package otherwise
+	// has none. Adding it means vendoring klauspost/compress/zstd (or
+	// accepting a compressor via an interface the caller supplies), which
+	// is a bigger design decision than WriterOptions should make silently.
 )
 
 // guessCompression returns the compression type of a data stream by matching
@@ -221,20 +276,27 @@ func (r *Reader) Close() {
 	}
 }
 
+// maxLineLength caps the size of a single header line readLine will
+// assemble, so a record with no blank-line separator (or a deliberately
+// huge header line) can't make the reader grow its buffer without bound.
+const maxLineLength = 1 << 20
+
 // readLine reads the next line in the opened WARC file.
 func (r *Reader) readLine() (string, error) {
 	data, isPrefix, err := r.reader.ReadLine()
 	if err != nil {
 		return "", err
 	}
-	// Line was too long for the buffer.
-	// TODO: rather return an error in this case? This function
-	// is only used on header fields and they shouldn't exceed the buffer size
-	// or should they?
+	// Line was too long for the bufio.Reader's internal buffer: keep
+	// reading and appending until we see the rest of it, or bail out once
+	// the line grows past maxLineLength.
 	if isPrefix {
 		buffer := new(bytes.Buffer)
 		buffer.Write(data)
 		for isPrefix {
+			if buffer.Len() > maxLineLength {
+				return "", fmt.Errorf("warc: header line exceeds %d bytes", maxLineLength)
+			}
 			data, isPrefix, err = r.reader.ReadLine()
 			if err != nil {
 				return "", err
@@ -273,6 +335,9 @@ func (r *Reader) ReadRecord() (*Record, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse field Content-Length: %v", err)
 	}
+	if length < 0 {
+		return nil, fmt.Errorf("field Content-Length must not be negative, got %d", length)
+	}
 	content, err := sliceReader(r.reader, length, r.mode == AsynchronousMode)
 	if err != nil {
 		return nil, err
@@ -328,57 +393,341 @@ func (r *Reader) Compression() CompressionType {
 	return r.compression
 }
 
-// NewWriter creates a new WARC writer.
+// NewWriter creates a new WARC writer that writes uncompressed records.
 func NewWriter(writer io.Writer) *Writer {
-	return &Writer{writer}
+	w, _ := NewWriterOptions(writer, WriterOptions{Compression: CompressionNone})
+	return w
+}
+
+// NewWriterLevel is like NewWriter, but compresses the written records with
+// compr at the given level, using one gzip member per record so the output
+// stays seekable. level follows the compress/gzip scale, e.g.
+// gzip.DefaultCompression.
+func NewWriterLevel(writer io.Writer, compr CompressionType, level int) (*Writer, error) {
+	return NewWriterOptions(writer, WriterOptions{
+		Compression:   compr,
+		Level:         level,
+		PerRecordGzip: true,
+	})
 }
 
-// WriteRecord writes a record to the underlying WARC file.
+// NewWriterOptions creates a new WARC writer configured by opts.
+func NewWriterOptions(writer io.Writer, opts WriterOptions) (*Writer, error) {
+	w := &Writer{
+		ComputeDigests: opts.ComputeDigests,
+		HashAlgorithm:  opts.DigestAlgorithm,
+		SpoolThreshold: opts.SpoolThreshold,
+		target:         writer,
+		opts:           opts,
+	}
+	switch opts.Compression {
+	case CompressionNone:
+	case CompressionGZIP:
+		gzipw, err := gzip.NewWriterLevel(writer, opts.Level)
+		if err != nil {
+			return nil, err
+		}
+		w.gzipw = gzipw
+	default:
+		return nil, fmt.Errorf("warc: writing %v is not supported", opts.Compression)
+	}
+	return w, nil
+}
+
+// Close flushes any buffered compressed data and closes the underlying
+// compressor. It is a no-op when the Writer writes uncompressed records, or
+// when gzipw was never actually written to (for example, a Writer used only
+// through CopyRecordRaw, which writes straight to target and never touches
+// gzipw) -- closing an unused compressor would otherwise append a spurious
+// empty gzip member to target.
+func (w *Writer) Close() error {
+	if w.gzipw != nil && w.gzipUsed {
+		return w.gzipw.Close()
+	}
+	return nil
+}
+
+// WriteRecord writes a record to the underlying WARC file. It reads all of
+// r.Content to learn Content-Length, spooling content of SpoolThreshold
+// bytes or more to a temporary file instead of holding it in RAM. Callers
+// that already know the content length should use WriteRecordSize, which
+// streams r.Content directly and never buffers it.
 func (w *Writer) WriteRecord(r *Record) (int, error) {
-	data, err := ioutil.ReadAll(r.Content)
+	content, size, cleanup, err := spoolContent(r.Content, w.SpoolThreshold)
+	defer cleanup()
 	if err != nil {
 		return 0, err
 	}
 
+	if w.ComputeDigests {
+		if err := w.setDigests(r, content); err != nil {
+			return 0, err
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	r.Content = content
+	n, err := w.WriteRecordSize(r, size)
+	return int(n), err
+}
+
+// WriteRecordSize writes r to the underlying WARC file like WriteRecord,
+// but trusts the caller-supplied contentLength instead of buffering
+// r.Content to learn it, streaming r.Content directly with io.Copy. This
+// lets multi-gigabyte payloads be written without ever holding them in
+// memory. Because the record header precedes the content on the wire,
+// WriteRecordSize cannot compute WARC-Block-Digest or WARC-Payload-Digest
+// the way WriteRecord does; set them on r.Header beforehand if the record
+// needs them.
+func (w *Writer) WriteRecordSize(r *Record, contentLength int64) (int64, error) {
 	// Content-Length is the number of octets in the content. If no content is
 	// present, a value of '0' (zero) shall be used.
-	r.Header["content-length"] = strconv.Itoa(len(data))
-	// If the values for WARC-Date and WARC-Type are missing, add them
-	// because the standard says they're mandatory.
+	r.Header["content-length"] = strconv.FormatInt(contentLength, 10)
+	if err := w.mandatoryFields(r); err != nil {
+		return 0, err
+	}
+
+	out := w.outWriter()
+	written, err := writeHeader(out, r.Header)
+	total := int64(written)
+	if err != nil {
+		return total, err
+	}
+
+	copied, err := io.Copy(out, r.Content)
+	total += copied
+	if err != nil {
+		return total, err
+	}
+	if copied != contentLength {
+		return total, fmt.Errorf("warc: wrote %d content bytes, want %d", copied, contentLength)
+	}
+	trailer, err := fmt.Fprintf(out, "\r\n\r\n")
+	total += int64(trailer)
+	if err != nil {
+		return total, err
+	}
+
+	if err := w.finishRecord(); err != nil {
+		return total, err
+	}
+	return total, nil
+}
+
+// WriteRecordFrom is a convenience wrapper around WriteRecordSize for
+// writing a slice of a large source file: it sets r.Content to the n bytes
+// of ra starting at off and streams them directly, without buffering.
+func (w *Writer) WriteRecordFrom(r *Record, ra io.ReaderAt, off, n int64) (int64, error) {
+	r.Content = io.NewSectionReader(ra, off, n)
+	return w.WriteRecordSize(r, n)
+}
+
+// mandatoryFields sets WARC-Date, WARC-Type and WARC-Record-ID on r.Header
+// if they're missing, since the standard requires all three.
+func (w *Writer) mandatoryFields(r *Record) error {
 	if r.Header["warc-date"] == "" {
 		r.Header["warc-date"] = time.Now().Format(time.RFC3339)
 	}
 	if r.Header["warc-type"] == "" {
 		r.Header["warc-type"] = "resource"
 	}
+	if r.Header["warc-record-id"] == "" {
+		id, err := newRecordID()
+		if err != nil {
+			return err
+		}
+		r.Header["warc-record-id"] = id
+	}
+	return nil
+}
+
+// setDigests computes WARC-Block-Digest, and WARC-Payload-Digest for
+// application/http records, by streaming content through a hash.Hash
+// instead of buffering it, and sets them on r.Header if not already
+// present. This keeps digest computation compatible with content spooled to
+// a temporary file by spoolContent.
+func (w *Writer) setDigests(r *Record, content io.Reader) error {
+	alg := w.HashAlgorithm
+	if alg == 0 {
+		alg = crypto.SHA1
+	}
+	contentType := strings.ToLower(r.Header["content-type"])
+	wantBlock := r.Header["warc-block-digest"] == ""
+	wantPayload := r.Header["warc-payload-digest"] == "" && strings.HasPrefix(contentType, "application/http")
+	if !wantBlock && !wantPayload {
+		return nil
+	}
+
+	h := newDigestHasher(alg, wantPayload)
+	if _, err := io.Copy(h, content); err != nil {
+		return err
+	}
+	if wantBlock {
+		r.Header["warc-block-digest"] = formatDigest(alg, h.block.Sum(nil))
+	}
+	if wantPayload && h.foundBoundary {
+		r.Header["warc-payload-digest"] = formatDigest(alg, h.payload.Sum(nil))
+	}
+	return nil
+}
 
+// digestHasher is an io.Writer that tees every byte written to it into a
+// block hash and, once it has seen the blank line that separates an HTTP
+// message's headers from its body, also tees every byte past that boundary
+// into a payload hash. It lets setDigests compute both digests in a single
+// streaming pass instead of buffering the content.
+type digestHasher struct {
+	block         hash.Hash
+	payload       hash.Hash // nil unless a payload digest was requested
+	foundBoundary bool
+	tail          []byte // up to 3 trailing bytes, in case "\r\n\r\n" straddles two Write calls
+}
+
+func newDigestHasher(alg crypto.Hash, wantPayload bool) *digestHasher {
+	h := &digestHasher{block: alg.New()}
+	if wantPayload {
+		h.payload = alg.New()
+	}
+	return h
+}
+
+func (h *digestHasher) Write(p []byte) (int, error) {
+	h.block.Write(p)
+	switch {
+	case h.payload == nil:
+	case h.foundBoundary:
+		h.payload.Write(p)
+	default:
+		buf := append(h.tail, p...)
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			h.foundBoundary = true
+			h.payload.Write(buf[i+4:])
+			h.tail = nil
+		} else if len(buf) > 3 {
+			h.tail = append([]byte(nil), buf[len(buf)-3:]...)
+		} else {
+			h.tail = append([]byte(nil), buf...)
+		}
+	}
+	return len(p), nil
+}
+
+// writeHeader writes the WARC version line, the record header and the
+// blank line that separates it from the content block:
+// 	Version CLRF
+// 	Header-Key: Header-Value CLRF
+// 	CLRF
+func writeHeader(out io.Writer, header Header) (int, error) {
 	total := 0
-	// write is a helper function to count the total number of
-	// written bytes to w.target.
 	write := func(format string, args ...interface{}) error {
-		written, err := fmt.Fprintf(w.target, format, args...)
+		written, err := fmt.Fprintf(out, format, args...)
 		total += written
 		return err
 	}
-
-	// A record consists of a version string, the record header followed by a
-	// record content block and two newlines:
-	// 	Version CLRF
-	// 	Header-Key: Header-Value CLRF
-	// 	CLRF
-	// 	Content
-	// 	CLRF
-	// 	CLRF
 	if err := write("%s\r\n", "WARC/1.0"); err != nil {
 		return total, err
 	}
-	for key, value := range r.Header {
+	for key, value := range header {
 		if err := write("%s: %s\r\n", strings.Title(key), value); err != nil {
 			return total, err
 		}
 	}
-	if err := write("\r\n%s\r\n\r\n", data); err != nil {
+	if err := write("\r\n"); err != nil {
 		return total, err
 	}
 	return total, nil
 }
+
+// outWriter returns the writer a record's bytes should actually go to: the
+// raw target for uncompressed output, or the gzip compressor otherwise.
+// When PerRecordGzip is set, the compressor is reset so the record becomes
+// its own independent gzip member.
+func (w *Writer) outWriter() io.Writer {
+	if w.gzipw == nil {
+		return w.target
+	}
+	w.gzipUsed = true
+	if w.opts.PerRecordGzip {
+		w.gzipw.Reset(w.target)
+	}
+	return w.gzipw
+}
+
+// finishRecord flushes or closes the gzip compressor once a record has been
+// written, depending on whether PerRecordGzip is set.
+func (w *Writer) finishRecord() error {
+	if w.gzipw == nil {
+		return nil
+	}
+	if w.opts.PerRecordGzip {
+		return w.gzipw.Close()
+	}
+	return w.gzipw.Flush()
+}
+
+// spoolContent reads r fully, so WriteRecord can learn the content's length
+// without holding arbitrarily large records in RAM. Content shorter than
+// threshold is kept in memory; content of threshold bytes or more is
+// written in full to a temporary file. A threshold of 0 disables spooling
+// and always buffers everything in memory. The returned cleanup function removes the temporary file, if any,
+// and must be called once the returned content has been consumed.
+func spoolContent(r io.Reader, threshold int64) (content io.ReadSeeker, size int64, cleanup func() error, err error) {
+	noop := func() error { return nil }
+	if threshold <= 0 {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, 0, noop, err
+		}
+		return bytes.NewReader(data), int64(len(data)), noop, nil
+	}
+
+	buffered, err := ioutil.ReadAll(io.LimitReader(r, threshold))
+	if err != nil {
+		return nil, 0, noop, err
+	}
+	if int64(len(buffered)) < threshold {
+		return bytes.NewReader(buffered), int64(len(buffered)), noop, nil
+	}
+
+	tmp, err := os.CreateTemp("", "warc")
+	if err != nil {
+		return nil, 0, noop, err
+	}
+	cleanup = func() error {
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	}
+	if _, err := tmp.Write(buffered); err != nil {
+		return nil, 0, cleanup, err
+	}
+	rest, err := io.Copy(tmp, r)
+	if err != nil {
+		return nil, 0, cleanup, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, cleanup, err
+	}
+	return tmp, int64(len(buffered)) + rest, cleanup, nil
+}
+
+// formatDigest returns sum, a digest computed with alg, in the
+// "<name>:<base32>" form WARC-Block-Digest and WARC-Payload-Digest use.
+func formatDigest(alg crypto.Hash, sum []byte) string {
+	// crypto.Hash names look like "SHA-1" or "SHA-256".
+	name := strings.ToLower(strings.Replace(alg.String(), "-", "", -1))
+	return fmt.Sprintf("%s:%s", name, base32.StdEncoding.EncodeToString(sum))
+}
+
+// newRecordID generates a random WARC-Record-ID in the "<urn:uuid:...>"
+// form the spec requires.
+func newRecordID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("<urn:uuid:%08x-%04x-%04x-%04x-%012x>",
+		b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -2,12 +2,15 @@ package warc_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/sha1"
+	"encoding/base32"
 	"fmt"
 	"github.com/slyrz/warc"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -156,6 +159,151 @@ func TestWriteRead(t *testing.T) {
 	}
 }
 
+func TestIndexedReaderRoundTrip(t *testing.T) {
+	buffer := new(bytes.Buffer)
+
+	writer, err := warc.NewWriterLevel(buffer, warc.CompressionGZIP, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for i, testRecord := range testRecords {
+		t.Logf("writing record %d", i)
+		record := warc.NewRecord()
+		record.Header = testRecord.Header
+		record.Content = bytes.NewReader(testRecord.Content)
+		if _, err := writer.WriteRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := warc.NewIndexedReader(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to create indexed reader: %v", err)
+	}
+	records := reader.Records()
+	if len(records) != len(testRecords) {
+		t.Fatalf("expected %d records, got %d", len(testRecords), len(records))
+	}
+	for i, testRecord := range testRecords {
+		t.Logf("reading record %d", i)
+		if reader.Find(records[i].RecordID) != i {
+			t.Errorf("Find(%q) did not return %d", records[i].RecordID, i)
+		}
+		record, err := reader.ReadAt(i)
+		if err != nil {
+			t.Fatalf("ReadAt(%d) failed: %v", i, err)
+		}
+		for key, val := range testRecord.Header {
+			if record.Header[key] != val {
+				t.Errorf("expected %q = %q, got %q", key, val, record.Header[key])
+			}
+		}
+		content, err := ioutil.ReadAll(record.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != string(testRecord.Content) {
+			t.Errorf("expected %s = %s", content, testRecord.Content)
+		}
+	}
+}
+
+func TestWriteRecordComputesDigests(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	writer := warc.NewWriter(buffer)
+	writer.ComputeDigests = true
+
+	httpHeader := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	payload := "Hello, World!"
+	content := []byte(httpHeader + payload)
+
+	record := warc.NewRecord()
+	record.Header["content-type"] = "application/http; msgtype=response"
+	record.Content = bytes.NewReader(content)
+	if _, err := writer.WriteRecord(record); err != nil {
+		t.Fatal(err)
+	}
+
+	blockSum := sha1.Sum(content)
+	wantBlock := fmt.Sprintf("sha1:%s", base32.StdEncoding.EncodeToString(blockSum[:]))
+	if record.Header["warc-block-digest"] != wantBlock {
+		t.Errorf("expected warc-block-digest %q, got %q", wantBlock, record.Header["warc-block-digest"])
+	}
+
+	payloadSum := sha1.Sum([]byte(payload))
+	wantPayload := fmt.Sprintf("sha1:%s", base32.StdEncoding.EncodeToString(payloadSum[:]))
+	if record.Header["warc-payload-digest"] != wantPayload {
+		t.Errorf("expected warc-payload-digest %q, got %q", wantPayload, record.Header["warc-payload-digest"])
+	}
+}
+
+func TestCopyRecordRaw(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	writer, err := warc.NewWriterLevel(buffer, warc.CompressionGZIP, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for i, testRecord := range testRecords {
+		record := warc.NewRecord()
+		record.Header = testRecord.Header
+		record.Content = bytes.NewReader(testRecord.Content)
+		if _, err := writer.WriteRecord(record); err != nil {
+			t.Fatalf("failed to write record %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := warc.NewIndexedReader(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to index source: %v", err)
+	}
+
+	out := new(bytes.Buffer)
+	dst, err := warc.NewWriterLevel(out, warc.CompressionGZIP, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatalf("failed to create destination writer: %v", err)
+	}
+	for _, ri := range src.Records() {
+		if _, err := dst.CopyRecordRaw(src, ri); err != nil {
+			t.Fatalf("CopyRecordRaw failed: %v", err)
+		}
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := warc.NewIndexedReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to index copy: %v", err)
+	}
+	if len(copied.Records()) != len(testRecords) {
+		t.Fatalf("expected %d records, got %d", len(testRecords), len(copied.Records()))
+	}
+	for i, testRecord := range testRecords {
+		record, err := copied.ReadAt(i)
+		if err != nil {
+			t.Fatalf("failed to read copied record %d: %v", i, err)
+		}
+		content, err := ioutil.ReadAll(record.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != string(testRecord.Content) {
+			t.Errorf("record %d: expected content %q, got %q", i, testRecord.Content, content)
+		}
+	}
+
+	plain := warc.NewWriter(new(bytes.Buffer))
+	if _, err := plain.CopyRecordRaw(src, src.Records()[0]); err == nil {
+		t.Fatal("expected CopyRecordRaw to reject a Writer that isn't in per-record gzip mode")
+	}
+}
+
 func ExampleReader() {
 	// Read WARC file from os.Stdin.
 	reader, err := warc.NewReader(os.Stdin)
@@ -176,6 +324,67 @@ func ExampleReader() {
 	}
 }
 
+// addReaderSeeds seeds f with the bundled WARC test files, if any are
+// present, plus a handful of handcrafted inputs exercising the edge cases
+// readers have historically gotten wrong: malformed and negative
+// Content-Length fields, a header line with no terminating blank line, an
+// oversized header line, and truncated gzip/bzip2 magic numbers.
+func addReaderSeeds(f *testing.F) {
+	paths, _ := filepath.Glob("testdata/*.warc*")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(""))
+	f.Add([]byte("WARC/1.0\r\n\r\n"))
+	f.Add([]byte("WARC/1.0\r\nContent-Length: -1\r\n\r\n\r\n\r\n"))
+	f.Add([]byte("WARC/1.0\r\nContent-Length: notanumber\r\n\r\n\r\n\r\n"))
+	f.Add([]byte("WARC/1.0\r\nContent-Length: 5\r\n\r\nhello"))
+	f.Add([]byte("WARC/1.0\r\n" + strings.Repeat("x", 1<<21) + ": y\r\n"))
+	f.Add([]byte{0x1f, 0x8b, 0x00})
+	f.Add([]byte{0x42, 0x5a, 0x00})
+}
+
+// fuzzReadRecords drives a Reader over data the way a real caller would:
+// read records one by one and consume their content, until ReadRecord
+// returns an error. It bounds the number of records read so that a bug
+// causing the Reader to never make progress fails the fuzz run instead of
+// hanging it.
+func fuzzReadRecords(t *testing.T, data []byte, mode warc.Mode) {
+	reader, err := warc.NewReaderMode(bytes.NewReader(data), mode)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	for i := 0; i < 10000; i++ {
+		record, err := reader.ReadRecord()
+		if err != nil {
+			return
+		}
+		if _, err := ioutil.ReadAll(record.Content); err != nil {
+			return
+		}
+	}
+	t.Fatalf("reader did not stop after 10000 records, looks like an infinite loop")
+}
+
+func FuzzReader(f *testing.F) {
+	addReaderSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzReadRecords(t, data, warc.AsynchronousMode)
+	})
+}
+
+func FuzzReaderSequential(f *testing.F) {
+	addReaderSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzReadRecords(t, data, warc.SequentialMode)
+	})
+}
+
 func ExampleWriter() {
 	// Write WARC records to os.Stdout.
 	writer := warc.NewWriter(os.Stdout)